@@ -10,82 +10,328 @@ package lsystem
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/xojoc/turtle"
 	"image/color"
-	"log"
+	"io"
+	"math/rand"
+	"os"
 	"strconv"
 	"strings"
 )
 
+// state is a snapshot of the turtle pushed on the stack by the push operation.
+type state struct {
+	x, y, a float64
+	c       color.Color
+	w       float64
+}
+
+// segment is one line drawn by a draw operation, recorded so it can be
+// replayed into an output backend other than the turtle's own PNG renderer.
+type segment struct {
+	x0, y0, x1, y1 float64
+	c              color.Color
+	w              float64
+}
+
+// WeightedRule is one alternative of a stochastic production: Replacement is
+// chosen with probability proportional to Weight among the alternatives
+// registered for the same symbol.
+type WeightedRule struct {
+	Weight      float64
+	Replacement string
+}
+
+// opKind identifies a pre-parsed operation, so Run never has to re-parse or
+// re-validate operation strings symbol by symbol.
+type opKind int
+
+const (
+	opPush opKind = iota
+	opPop
+	opRotate
+	opMove
+	opDraw
+	opSetColor
+	opSetWidth
+)
+
+// compiledOp is one operation parsed out of an operations string, with its
+// arguments already converted to their final types.
+type compiledOp struct {
+	kind  opKind
+	angle float64
+	dist  float64
+	col   color.Color
+	width float64
+}
+
 // LSystem keeps track of the state of the L-system.
 type LSystem struct {
 	t          *turtle.Turtle
-	rules      map[rune]string
-	operations map[rune]string
-	stack      [][3]float64
+	rules      map[rune][]WeightedRule
+	operations map[rune][]compiledOp
+	stack      []state
+	rnd        *rand.Rand
+	segments   []segment
+	color      color.Color
+	width      float64
 }
 
 // New generates a new L-system. Rules are the rewriting rules.
-// Operations is the set of operations to perform for each symbol.
+// Operations is the set of operations to perform for each symbol. New
+// returns an error if an operation string is malformed, so it can safely be
+// used to validate L-systems built from untrusted input.
 //
 // List of operations:
-//    push - Save x,y coordinates and angle on the stack.
-//    pop - Load x,y coordinates and angle from the stack.
+//    push - Save x,y coordinates, angle, color and width on the stack.
+//    pop - Load x,y coordinates, angle, color and width from the stack.
 //    rotate N - Change the direction of the next drawing operation by N degrees.
 //    move N - Move by N pixels without drawing.
 //    draw C W L - Draw a line with color C (in #rrggbbaa notation), width W and long L pixels
-func New(rules map[rune]string, operations map[rune]string) *LSystem {
+//    set-color C - Change the current color to C (in #rrggbbaa notation) without drawing.
+//    set-width W - Change the current width to W without drawing.
+func New(rules map[rune]string, operations map[rune]string) (*LSystem, error) {
+	wrules := map[rune][]WeightedRule{}
+	for s, r := range rules {
+		wrules[s] = []WeightedRule{{Weight: 1, Replacement: r}}
+	}
+	return newLSystem(wrules, operations, nil)
+}
+
+// NewStochastic generates a new stochastic L-system, where a symbol may have
+// several alternative productions picked at random according to their
+// weight. seed makes the choice of alternatives reproducible.
+func NewStochastic(rules map[rune][]WeightedRule, operations map[rune]string, seed int64) (*LSystem, error) {
+	return newLSystem(rules, operations, rand.New(rand.NewSource(seed)))
+}
+
+func newLSystem(rules map[rune][]WeightedRule, operations map[rune]string, rnd *rand.Rand) (*LSystem, error) {
+	for sym, alts := range rules {
+		if len(alts) == 0 {
+			return nil, fmt.Errorf("symbol %q has no productions", sym)
+		}
+	}
+	compiled, err := compileOps(operations)
+	if err != nil {
+		return nil, err
+	}
 	l := &LSystem{}
 	l.t = turtle.New()
 	l.rules = rules
-	l.operations = operations
-	l.stack = [][3]float64{}
-	return l
+	l.operations = compiled
+	l.stack = []state{}
+	l.rnd = rnd
+	// Mirrors turtle.New's own initial color and width, which it has no
+	// getters for.
+	l.color = color.RGBA{0, 0, 0, 0xff}
+	l.width = 5.0
+	return l, nil
+}
+
+// compileOps parses every operations string once, so Run executes
+// pre-parsed compiledOps instead of re-parsing strings for every symbol.
+func compileOps(operations map[rune]string) (map[rune][]compiledOp, error) {
+	compiled := map[rune][]compiledOp{}
+	for sym, o := range operations {
+		fields := strings.Fields(o)
+		var ops []compiledOp
+		for q := 0; q < len(fields); q++ {
+			switch fields[q] {
+			case "push":
+				ops = append(ops, compiledOp{kind: opPush})
+			case "pop":
+				ops = append(ops, compiledOp{kind: opPop})
+			case "rotate":
+				arg, next, err := nextField(fields, q)
+				if err != nil {
+					return nil, err
+				}
+				a, err := parsef64(arg)
+				if err != nil {
+					return nil, err
+				}
+				q = next
+				ops = append(ops, compiledOp{kind: opRotate, angle: a})
+			case "move":
+				arg, next, err := nextField(fields, q)
+				if err != nil {
+					return nil, err
+				}
+				d, err := parsef64(arg)
+				if err != nil {
+					return nil, err
+				}
+				q = next
+				ops = append(ops, compiledOp{kind: opMove, dist: d})
+			case "draw":
+				arg, next, err := nextField(fields, q)
+				if err != nil {
+					return nil, err
+				}
+				c, err := parseColor(arg)
+				if err != nil {
+					return nil, err
+				}
+				q = next
+				arg, next, err = nextField(fields, q)
+				if err != nil {
+					return nil, err
+				}
+				w, err := parsef64(arg)
+				if err != nil {
+					return nil, err
+				}
+				q = next
+				arg, next, err = nextField(fields, q)
+				if err != nil {
+					return nil, err
+				}
+				d, err := parsef64(arg)
+				if err != nil {
+					return nil, err
+				}
+				q = next
+				ops = append(ops, compiledOp{kind: opDraw, col: c, width: w, dist: d})
+			case "set-color":
+				arg, next, err := nextField(fields, q)
+				if err != nil {
+					return nil, err
+				}
+				c, err := parseColor(arg)
+				if err != nil {
+					return nil, err
+				}
+				q = next
+				ops = append(ops, compiledOp{kind: opSetColor, col: c})
+			case "set-width":
+				arg, next, err := nextField(fields, q)
+				if err != nil {
+					return nil, err
+				}
+				w, err := parsef64(arg)
+				if err != nil {
+					return nil, err
+				}
+				q = next
+				ops = append(ops, compiledOp{kind: opSetWidth, width: w})
+			default:
+				return nil, fmt.Errorf("unknown operation: %s", fields[q])
+			}
+		}
+		compiled[sym] = ops
+	}
+	return compiled, nil
+}
+
+// nextField returns the field following q, along with its index, or an
+// error if the operation string ends before the expected argument.
+func nextField(fields []string, q int) (string, int, error) {
+	q++
+	if q >= len(fields) {
+		return "", 0, fmt.Errorf("operation %q is missing an argument", fields[q-1])
+	}
+	return fields[q], q, nil
+}
+
+// choose picks one of the weighted alternatives for a symbol, using
+// cumulative weight. With a single alternative (the common, non-stochastic
+// case) no randomness is involved.
+func (l *LSystem) choose(alts []WeightedRule) string {
+	if len(alts) == 1 {
+		return alts[0].Replacement
+	}
+	total := 0.0
+	for _, a := range alts {
+		total += a.Weight
+	}
+	r := l.rnd.Float64() * total
+	cum := 0.0
+	for _, a := range alts {
+		cum += a.Weight
+		if r < cum {
+			return a.Replacement
+		}
+	}
+	return alts[len(alts)-1].Replacement
+}
+
+// setColor changes the current drawing color, keeping the L-system's own
+// record of it in sync since turtle.Turtle exposes no getter to read it back.
+func (l *LSystem) setColor(c color.Color) {
+	l.t.SetColor(c)
+	l.color = c
+}
+
+// setWidth changes the current pen width, keeping the L-system's own record
+// of it in sync since turtle.Turtle exposes no getter to read it back.
+func (l *LSystem) setWidth(w float64) {
+	l.t.SetWidth(w)
+	l.width = w
 }
 
 func (l *LSystem) push() {
-	x := l.t.X
-	y := l.t.Y
-	a := l.t.A
-	l.stack = append(l.stack, [3]float64{x, y, a})
-}
-func (l *LSystem) pop() {
-	x := l.stack[len(l.stack)-1][0]
-	y := l.stack[len(l.stack)-1][1]
-	a := l.stack[len(l.stack)-1][2]
+	l.stack = append(l.stack, state{l.t.X, l.t.Y, l.t.A, l.color, l.width})
+}
+func (l *LSystem) pop() error {
+	if len(l.stack) == 0 {
+		return fmt.Errorf("pop: stack is empty")
+	}
+	s := l.stack[len(l.stack)-1]
 	l.stack = l.stack[:len(l.stack)-1]
-	l.t.X = x
-	l.t.Y = y
-	l.t.A = a
+	l.t.X = s.x
+	l.t.Y = s.y
+	l.t.A = s.a
+	l.setColor(s.c)
+	l.setWidth(s.w)
+	return nil
 }
 
-func parsef64(str string) float64 {
-	f, err := strconv.ParseFloat(str, 64)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return f
+func parsef64(str string) (float64, error) {
+	return strconv.ParseFloat(str, 64)
 }
-func hex(str string) uint8 {
+func hex(str string) (uint8, error) {
 	i, err := strconv.ParseUint(str, 16, 8)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	return uint8(i)
+	return uint8(i), nil
 }
-func parseColor(str string) color.Color {
+func parseColor(str string) (color.Color, error) {
+	if len(str) != 9 || str[0] != '#' {
+		return nil, fmt.Errorf("malformed color: %q", str)
+	}
 	str = str[1:]
-	return color.RGBA{hex(str[:2]), hex(str[2:4]), hex(str[4:6]), hex(str[6:8])}
+	r, err := hex(str[0:2])
+	if err != nil {
+		return nil, err
+	}
+	g, err := hex(str[2:4])
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex(str[4:6])
+	if err != nil {
+		return nil, err
+	}
+	a, err := hex(str[6:8])
+	if err != nil {
+		return nil, err
+	}
+	return color.RGBA{r, g, b, a}, nil
 }
 
-// Run applies the L-system rules i times starting from axiom.
-func (l *LSystem) Run(axiom string, i int) {
+// Run applies the L-system rules i times starting from axiom, then drives
+// the turtle through the resulting, pre-compiled operations.
+func (l *LSystem) Run(axiom string, i int) error {
+	l.segments = nil
 	s := axiom
 	for j := 0; j < i; j++ {
 		var buf bytes.Buffer
 		for k := 0; k < len(s); k++ {
 			if v, ok := l.rules[rune(s[k])]; ok {
-				buf.WriteString(v)
+				buf.WriteString(l.choose(v))
 			} else {
 				buf.WriteByte(s[k])
 			}
@@ -93,35 +339,38 @@ func (l *LSystem) Run(axiom string, i int) {
 		s = buf.String()
 	}
 	for j := 0; j < len(s); j++ {
-		if o, ok := l.operations[rune(s[j])]; ok {
-			fields := strings.Fields(o)
-			for q := 0; q < len(fields); q++ {
-				switch fields[q] {
-				case "push":
-					l.push()
-				case "pop":
-					l.pop()
-				case "rotate":
-					q++
-					l.t.Rotate(parsef64(fields[q]))
-				case "move":
-					q++
-					l.t.PenUp()
-					l.t.Move(parsef64(fields[q]))
-					l.t.PenDown()
-				case "draw":
-					q++
-					l.t.SetColor(parseColor(fields[q]))
-					q++
-					l.t.SetWidth(parsef64(fields[q]))
-					q++
-					l.t.Move(parsef64(fields[q]))
-				default:
-					log.Fatal("unknown operation: " + fields[q])
+		ops, ok := l.operations[rune(s[j])]
+		if !ok {
+			continue
+		}
+		for _, op := range ops {
+			switch op.kind {
+			case opPush:
+				l.push()
+			case opPop:
+				if err := l.pop(); err != nil {
+					return err
 				}
+			case opRotate:
+				l.t.Rotate(op.angle)
+			case opMove:
+				l.t.PenUp()
+				l.t.Move(op.dist)
+				l.t.PenDown()
+			case opDraw:
+				l.setColor(op.col)
+				l.setWidth(op.width)
+				x0, y0 := l.t.X, l.t.Y
+				l.t.Move(op.dist)
+				l.segments = append(l.segments, segment{x0, y0, l.t.X, l.t.Y, op.col, op.width})
+			case opSetColor:
+				l.setColor(op.col)
+			case opSetWidth:
+				l.setWidth(op.width)
 			}
 		}
 	}
+	return nil
 }
 
 // Save saves the image produced after executing Run in the given file name.
@@ -130,3 +379,77 @@ func (l *LSystem) Run(axiom string, i int) {
 func (l *LSystem) Save(name string) error {
 	return l.t.Save(name)
 }
+
+// SaveSVG saves the path drawn by the last Run as a self-contained SVG
+// document in the given file name, giving a crisp, arbitrary-resolution
+// rendering unlike the raster output of Save.
+func (l *LSystem) SaveSVG(name string) error {
+	return saveSVG(name, l.segments)
+}
+
+// saveSVG writes segments as an SVG document to the given file name, shared
+// by both LSystem and ParametricLSystem.
+func saveSVG(name string, segments []segment) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := writeSVG(f, segments); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteSVG writes the path drawn by the last Run as a self-contained SVG
+// document to w, one <line> per recorded draw operation.
+func (l *LSystem) WriteSVG(w io.Writer) error {
+	return writeSVG(w, l.segments)
+}
+
+// writeSVG writes segments as a self-contained SVG document to w, one
+// <line> per segment, shared by both LSystem and ParametricLSystem.
+func writeSVG(w io.Writer, segments []segment) error {
+	minX, minY, maxX, maxY := 0.0, 0.0, 0.0, 0.0
+	for i, s := range segments {
+		if i == 0 {
+			minX, maxX = s.x0, s.x0
+			minY, maxY = s.y0, s.y0
+		}
+		for _, x := range []float64{s.x0, s.x1} {
+			if x < minX {
+				minX = x
+			}
+			if x > maxX {
+				maxX = x
+			}
+		}
+		for _, y := range []float64{s.y0, s.y1} {
+			if y < minY {
+				minY = y
+			}
+			if y > maxY {
+				maxY = y
+			}
+		}
+	}
+	if _, err := fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<svg xmlns=\"http://www.w3.org/2000/svg\" viewBox=\"%g %g %g %g\">\n",
+		minX, minY, maxX-minX, maxY-minY); err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if _, err := fmt.Fprintf(w, "<line x1=\"%g\" y1=\"%g\" x2=\"%g\" y2=\"%g\" stroke=\"%s\" stroke-width=\"%g\" stroke-linecap=\"round\"/>\n",
+			s.x0, s.y0, s.x1, s.y1, colorToHex(s.c), s.w); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprint(w, "</svg>\n")
+	return err
+}
+
+// colorToHex formats c in the #rrggbbaa notation used by draw operations.
+func colorToHex(c color.Color) string {
+	r := color.RGBAModel.Convert(c).(color.RGBA)
+	return fmt.Sprintf("#%02x%02x%02x%02x", r.R, r.G, r.B, r.A)
+}
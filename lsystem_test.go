@@ -0,0 +1,106 @@
+package lsystem
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewStochasticRejectsEmptyAlternatives(t *testing.T) {
+	rules := map[rune][]WeightedRule{'F': {}}
+	if _, err := NewStochastic(rules, nil, 1); err == nil {
+		t.Fatal("NewStochastic: expected an error for a symbol with no productions, got nil")
+	}
+}
+
+func TestChooseIsDeterministicWithSeed(t *testing.T) {
+	rules := map[rune][]WeightedRule{
+		'F': {
+			{Weight: 1, Replacement: "A"},
+			{Weight: 1, Replacement: "B"},
+		},
+	}
+	l, err := NewStochastic(rules, map[rune]string{}, 42)
+	if err != nil {
+		t.Fatalf("NewStochastic: %v", err)
+	}
+	got := l.choose(rules['F'])
+	l2, _ := NewStochastic(rules, map[rune]string{}, 42)
+	got2 := l2.choose(rules['F'])
+	if got != got2 {
+		t.Errorf("choose with the same seed produced %q then %q, want equal", got, got2)
+	}
+}
+
+func TestPopOnEmptyStack(t *testing.T) {
+	l, err := New(nil, map[rune]string{']': "pop"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := l.Run("]", 0); err == nil {
+		t.Fatal("Run: expected an error for pop on an empty stack, got nil")
+	}
+}
+
+func TestPushPopRestoresColorAndWidth(t *testing.T) {
+	l, err := New(nil, map[rune]string{
+		'[': "push",
+		']': "pop",
+		'R': "set-color #ff0000ff",
+		'W': "set-width 9",
+		'g': "set-color #00ff00ff",
+		'w': "set-width 3",
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := l.Run("RW[gw]", 0); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := colorToHex(l.color); got != "#ff0000ff" {
+		t.Errorf("color after pop = %s, want #ff0000ff (the value at push time)", got)
+	}
+	if l.width != 9 {
+		t.Errorf("width after pop = %v, want 9 (the value at push time)", l.width)
+	}
+}
+
+func TestWriteSVGOneLinePerDraw(t *testing.T) {
+	l, err := New(nil, map[rune]string{
+		'F': "draw #ff0000ff 1 10",
+		'+': "rotate 90",
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := l.Run("F+F", 0); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := l.WriteSVG(&buf); err != nil {
+		t.Fatalf("WriteSVG: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "<svg") || !strings.Contains(out, "</svg>") {
+		t.Errorf("WriteSVG output missing <svg>/</svg>: %s", out)
+	}
+	if strings.Count(out, "<line") != 2 {
+		t.Errorf("WriteSVG output has %d <line> elements, want 2:\n%s", strings.Count(out, "<line"), out)
+	}
+}
+
+func TestNewRejectsMalformedOperations(t *testing.T) {
+	cases := map[string]string{
+		"missing rotate angle": "rotate",
+		"missing draw args":    "draw #ff0000ff",
+		"bad color":            "draw #zzzzzzzz 1 1",
+		"unknown op":           "frobnicate",
+	}
+	for name, op := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New(nil, map[rune]string{'F': op}); err == nil {
+				t.Errorf("New(%q): expected an error, got nil", op)
+			}
+		})
+	}
+}
@@ -0,0 +1,635 @@
+// This package was written by xojoc (http://xojoc.pw)
+// and is in the Public Domain do what you want with it.
+
+package lsystem
+
+import (
+	"fmt"
+	"github.com/xojoc/turtle"
+	"image/color"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// paramExpr is a compiled arithmetic or comparison expression over a
+// production's parameter bindings, e.g. "x*0.5" or "y>0".
+type paramExpr func(args []float64) float64
+
+var exprToken = regexp.MustCompile(`\d+\.\d+|\d+|[A-Za-z_]\w*|>=|<=|==|!=|[()+\-*/,><]`)
+
+// exprParser is a small recursive-descent parser for the arithmetic and
+// comparison expressions found in parametric productions (guards and
+// replacement arguments).
+type exprParser struct {
+	tokens []string
+	pos    int
+	params map[string]int
+}
+
+func newExprParser(src string, params map[string]int) *exprParser {
+	return &exprParser{tokens: exprToken.FindAllString(src, -1), params: params}
+}
+
+func (p *exprParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// parseExpr parses a full expression, optionally followed by a single
+// comparison operator, e.g. used for guards such as "y>0".
+func (p *exprParser) parseExpr() (paramExpr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	switch p.peek() {
+	case ">", "<", ">=", "<=", "==", "!=":
+		op := p.next()
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return compare(op, left, right), nil
+	}
+	return left, nil
+}
+
+func compare(op string, left, right paramExpr) paramExpr {
+	return func(args []float64) float64 {
+		l, r := left(args), right(args)
+		var ok bool
+		switch op {
+		case ">":
+			ok = l > r
+		case "<":
+			ok = l < r
+		case ">=":
+			ok = l >= r
+		case "<=":
+			ok = l <= r
+		case "==":
+			ok = l == r
+		case "!=":
+			ok = l != r
+		}
+		if ok {
+			return 1
+		}
+		return 0
+	}
+}
+
+func (p *exprParser) parseAdditive() (paramExpr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.next()
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = arith(op, left, right)
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseMultiplicative() (paramExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = arith(op, left, right)
+	}
+	return left, nil
+}
+
+func arith(op string, left, right paramExpr) paramExpr {
+	return func(args []float64) float64 {
+		switch op {
+		case "+":
+			return left(args) + right(args)
+		case "-":
+			return left(args) - right(args)
+		case "*":
+			return left(args) * right(args)
+		case "/":
+			return left(args) / right(args)
+		}
+		return 0
+	}
+}
+
+func (p *exprParser) parseUnary() (paramExpr, error) {
+	if p.peek() == "-" {
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(args []float64) float64 { return -e(args) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (paramExpr, error) {
+	t := p.next()
+	switch {
+	case t == "(":
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return e, nil
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case t[0] >= '0' && t[0] <= '9':
+		v, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, err
+		}
+		return func(args []float64) float64 { return v }, nil
+	default:
+		idx, ok := p.params[t]
+		if !ok {
+			return nil, fmt.Errorf("unknown parameter: %s", t)
+		}
+		return func(args []float64) float64 { return args[idx] }, nil
+	}
+}
+
+// rhsSymbol is one symbol emitted by a parametric production's replacement,
+// together with the expressions computing its arguments.
+type rhsSymbol struct {
+	sym  rune
+	args []paramExpr
+}
+
+// paramProduction is one parsed parametric production for a symbol, e.g.
+// "F(x,y) : y>0 -> F(x*0.5, y-1) [+F(x,y-1)] -F(x,y-1)".
+type paramProduction struct {
+	arity       int
+	paramNames  map[string]int
+	guard       paramExpr
+	replacement []rhsSymbol
+}
+
+// matches reports whether this production applies to a symbol occurrence
+// with the given arguments, checking both arity and guard.
+func (pr *paramProduction) matches(args []float64) bool {
+	if len(args) != pr.arity {
+		return false
+	}
+	if pr.guard == nil {
+		return true
+	}
+	return pr.guard(args) != 0
+}
+
+// parseParamProduction parses a single production string, as passed in
+// ParametricLSystem rules, into its compiled form.
+func parseParamProduction(prod string) (rune, *paramProduction, error) {
+	arrow := strings.Index(prod, "->")
+	if arrow < 0 {
+		return 0, nil, fmt.Errorf("missing -> in production: %q", prod)
+	}
+	lhs := strings.TrimSpace(prod[:arrow])
+	rhs := strings.TrimSpace(prod[arrow+2:])
+
+	guardSrc := ""
+	if colon := strings.Index(lhs, ":"); colon >= 0 {
+		guardSrc = strings.TrimSpace(lhs[colon+1:])
+		lhs = strings.TrimSpace(lhs[:colon])
+	}
+
+	sym, paramNames, err := parseSymbolSignature(lhs)
+	if err != nil {
+		return 0, nil, err
+	}
+	params := map[string]int{}
+	for i, n := range paramNames {
+		params[n] = i
+	}
+
+	var guard paramExpr
+	if guardSrc != "" {
+		guard, err = newExprParser(guardSrc, params).parseExpr()
+		if err != nil {
+			return 0, nil, fmt.Errorf("production %q: %v", prod, err)
+		}
+	}
+
+	replacement, err := parseRHS(rhs, params)
+	if err != nil {
+		return 0, nil, fmt.Errorf("production %q: %v", prod, err)
+	}
+
+	return sym, &paramProduction{
+		arity:       len(paramNames),
+		paramNames:  params,
+		guard:       guard,
+		replacement: replacement,
+	}, nil
+}
+
+// parseSymbolSignature parses "F(x,y)" or a bare "F" into its symbol and
+// parameter names.
+func parseSymbolSignature(s string) (rune, []string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil, fmt.Errorf("empty symbol")
+	}
+	r := []rune(s)[0]
+	rest := strings.TrimSpace(string([]rune(s)[1:]))
+	if rest == "" {
+		return r, nil, nil
+	}
+	if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+		return 0, nil, fmt.Errorf("malformed symbol signature: %q", s)
+	}
+	inner := rest[1 : len(rest)-1]
+	if strings.TrimSpace(inner) == "" {
+		return r, nil, nil
+	}
+	var names []string
+	for _, p := range strings.Split(inner, ",") {
+		names = append(names, strings.TrimSpace(p))
+	}
+	return r, names, nil
+}
+
+// parseRHS parses the replacement side of a production, e.g.
+// "F(x*0.5, y-1) [+F(x,y-1)] -F(x,y-1)".
+func parseRHS(s string, params map[string]int) ([]rhsSymbol, error) {
+	var out []rhsSymbol
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		if runes[i] == ' ' || runes[i] == '\t' {
+			i++
+			continue
+		}
+		sym := runes[i]
+		i++
+		var args []paramExpr
+		if i < len(runes) && runes[i] == '(' {
+			depth := 1
+			start := i + 1
+			j := start
+			for ; j < len(runes) && depth > 0; j++ {
+				switch runes[j] {
+				case '(':
+					depth++
+				case ')':
+					depth--
+				}
+			}
+			if depth != 0 {
+				return nil, fmt.Errorf("unbalanced parenthesis after %c", sym)
+			}
+			inner := string(runes[start : j-1])
+			if strings.TrimSpace(inner) != "" {
+				for _, a := range splitTopLevel(inner) {
+					e, err := newExprParser(a, params).parseExpr()
+					if err != nil {
+						return nil, err
+					}
+					args = append(args, e)
+				}
+			}
+			i = j
+		}
+		out = append(out, rhsSymbol{sym: sym, args: args})
+	}
+	return out, nil
+}
+
+// splitTopLevel splits a comma-separated argument list, ignoring commas
+// nested inside parentheses.
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, s[start:])
+	return parts
+}
+
+// symbol is one occurrence of a symbol together with its bound arguments,
+// the parametric equivalent of a single rune in the rune-based API.
+type symbol struct {
+	sym  rune
+	args []float64
+}
+
+// ParametricLSystem keeps track of the state of a parametric L-system, where
+// symbols carry numeric parameters and productions can be conditioned on
+// them. See NewParametric.
+type ParametricLSystem struct {
+	t          *turtle.Turtle
+	rules      map[rune][]*paramProduction
+	operations map[rune]string
+	stack      []state
+	color      color.Color
+	width      float64
+	segments   []segment
+}
+
+// NewParametric generates a new parametric L-system. Rules are production
+// strings such as "F(x,y) : y>0 -> F(x*0.5, y-1) [+F(x,y-1)] -F(x,y-1)"; a
+// symbol may have several productions, the first whose parameter count and
+// guard match the current occurrence is applied. Operations are as in New,
+// except that a numeric field of the form $N refers to the argument at index
+// N (counting from 0) of the symbol being processed instead of a literal value.
+//
+// Unlike New, operations here aren't pre-compiled: $N references can only be
+// resolved once a symbol's arguments are known, so operation strings are
+// parsed on every Run instead of once up front. Malformed strings still
+// surface as an error rather than a panic, just later than for the
+// rune-based API.
+func NewParametric(rules map[rune][]string, operations map[rune]string) (*ParametricLSystem, error) {
+	compiled := map[rune][]*paramProduction{}
+	for _, prods := range rules {
+		for _, prod := range prods {
+			sym, pr, err := parseParamProduction(prod)
+			if err != nil {
+				return nil, err
+			}
+			compiled[sym] = append(compiled[sym], pr)
+		}
+	}
+	l := &ParametricLSystem{}
+	l.t = turtle.New()
+	l.rules = compiled
+	l.operations = operations
+	l.stack = []state{}
+	// Mirrors turtle.New's own initial color and width, which it has no
+	// getters for.
+	l.color = color.RGBA{0, 0, 0, 0xff}
+	l.width = 5.0
+	return l, nil
+}
+
+// setColor changes the current drawing color, keeping the L-system's own
+// record of it in sync since turtle.Turtle exposes no getter to read it back.
+func (l *ParametricLSystem) setColor(c color.Color) {
+	l.t.SetColor(c)
+	l.color = c
+}
+
+// setWidth changes the current pen width, keeping the L-system's own record
+// of it in sync since turtle.Turtle exposes no getter to read it back.
+func (l *ParametricLSystem) setWidth(w float64) {
+	l.t.SetWidth(w)
+	l.width = w
+}
+
+func (l *ParametricLSystem) push() {
+	l.stack = append(l.stack, state{l.t.X, l.t.Y, l.t.A, l.color, l.width})
+}
+func (l *ParametricLSystem) pop() error {
+	if len(l.stack) == 0 {
+		return fmt.Errorf("pop: stack is empty")
+	}
+	s := l.stack[len(l.stack)-1]
+	l.stack = l.stack[:len(l.stack)-1]
+	l.t.X = s.x
+	l.t.Y = s.y
+	l.t.A = s.a
+	l.setColor(s.c)
+	l.setWidth(s.w)
+	return nil
+}
+
+// parseAxiom parses an axiom such as "F(1,5)" into its symbol occurrences.
+func parseAxiom(axiom string) ([]symbol, error) {
+	rhs, err := parseRHS(axiom, nil)
+	if err != nil {
+		return nil, err
+	}
+	syms := make([]symbol, len(rhs))
+	for i, r := range rhs {
+		args := make([]float64, len(r.args))
+		for j, a := range r.args {
+			args[j] = a(nil)
+		}
+		syms[i] = symbol{sym: r.sym, args: args}
+	}
+	return syms, nil
+}
+
+// Run applies the L-system rules i times starting from axiom, then drives
+// the turtle through the resulting operations.
+func (l *ParametricLSystem) Run(axiom string, i int) error {
+	l.segments = nil
+	s, err := parseAxiom(axiom)
+	if err != nil {
+		return err
+	}
+	for j := 0; j < i; j++ {
+		var next []symbol
+		for _, occ := range s {
+			pr := l.matchingProduction(occ)
+			if pr == nil {
+				next = append(next, occ)
+				continue
+			}
+			for _, r := range pr.replacement {
+				args := make([]float64, len(r.args))
+				for k, a := range r.args {
+					args[k] = a(occ.args)
+				}
+				next = append(next, symbol{sym: r.sym, args: args})
+			}
+		}
+		s = next
+	}
+	for _, occ := range s {
+		o, ok := l.operations[occ.sym]
+		if !ok {
+			continue
+		}
+		if err := l.runOp(o, occ.args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchingProduction returns the first production registered for occ's
+// symbol whose arity and guard match, or nil if occ should be left as is.
+func (l *ParametricLSystem) matchingProduction(occ symbol) *paramProduction {
+	for _, pr := range l.rules[occ.sym] {
+		if pr.matches(occ.args) {
+			return pr
+		}
+	}
+	return nil
+}
+
+// opArg resolves one operation field: either a literal number, or, if it
+// starts with $, the argument at index N (counting from 0) of the symbol
+// being processed.
+func opArg(field string, args []float64) (float64, error) {
+	if strings.HasPrefix(field, "$") {
+		n, err := strconv.Atoi(field[1:])
+		if err != nil {
+			return 0, fmt.Errorf("bad parameter reference %q: %v", field, err)
+		}
+		if n < 0 || n >= len(args) {
+			return 0, fmt.Errorf("parameter reference %q out of range", field)
+		}
+		return args[n], nil
+	}
+	f, err := strconv.ParseFloat(field, 64)
+	if err != nil {
+		return 0, err
+	}
+	return f, nil
+}
+
+func (l *ParametricLSystem) runOp(o string, args []float64) error {
+	fields := strings.Fields(o)
+	for q := 0; q < len(fields); q++ {
+		switch fields[q] {
+		case "push":
+			l.push()
+		case "pop":
+			if err := l.pop(); err != nil {
+				return err
+			}
+		case "rotate":
+			field, next, err := nextField(fields, q)
+			if err != nil {
+				return err
+			}
+			a, err := opArg(field, args)
+			if err != nil {
+				return err
+			}
+			q = next
+			l.t.Rotate(a)
+		case "move":
+			field, next, err := nextField(fields, q)
+			if err != nil {
+				return err
+			}
+			a, err := opArg(field, args)
+			if err != nil {
+				return err
+			}
+			q = next
+			l.t.PenUp()
+			l.t.Move(a)
+			l.t.PenDown()
+		case "draw":
+			field, next, err := nextField(fields, q)
+			if err != nil {
+				return err
+			}
+			c, err := parseColor(field)
+			if err != nil {
+				return err
+			}
+			q = next
+			l.setColor(c)
+			field, next, err = nextField(fields, q)
+			if err != nil {
+				return err
+			}
+			w, err := opArg(field, args)
+			if err != nil {
+				return err
+			}
+			q = next
+			l.setWidth(w)
+			field, next, err = nextField(fields, q)
+			if err != nil {
+				return err
+			}
+			d, err := opArg(field, args)
+			if err != nil {
+				return err
+			}
+			q = next
+			x0, y0 := l.t.X, l.t.Y
+			l.t.Move(d)
+			l.segments = append(l.segments, segment{x0, y0, l.t.X, l.t.Y, l.color, l.width})
+		case "set-color":
+			field, next, err := nextField(fields, q)
+			if err != nil {
+				return err
+			}
+			c, err := parseColor(field)
+			if err != nil {
+				return err
+			}
+			q = next
+			l.setColor(c)
+		case "set-width":
+			field, next, err := nextField(fields, q)
+			if err != nil {
+				return err
+			}
+			w, err := opArg(field, args)
+			if err != nil {
+				return err
+			}
+			q = next
+			l.setWidth(w)
+		default:
+			return fmt.Errorf("unknown operation: %s", fields[q])
+		}
+	}
+	return nil
+}
+
+// Save saves the image produced after executing Run in the given file name.
+// The file format is based on the extension. Currently only PNG is supported,
+// with extension .png.
+func (l *ParametricLSystem) Save(name string) error {
+	return l.t.Save(name)
+}
+
+// SaveSVG saves the path drawn by the last Run as a self-contained SVG
+// document in the given file name, giving a crisp, arbitrary-resolution
+// rendering unlike the raster output of Save.
+func (l *ParametricLSystem) SaveSVG(name string) error {
+	return saveSVG(name, l.segments)
+}
+
+// WriteSVG writes the path drawn by the last Run as a self-contained SVG
+// document to w, one <line> per recorded draw operation.
+func (l *ParametricLSystem) WriteSVG(w io.Writer) error {
+	return writeSVG(w, l.segments)
+}
@@ -0,0 +1,110 @@
+package lsystem
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParametricPopOnEmptyStack(t *testing.T) {
+	l, err := NewParametric(
+		map[rune][]string{},
+		map[rune]string{']': "pop"},
+	)
+	if err != nil {
+		t.Fatalf("NewParametric: %v", err)
+	}
+	if err := l.Run("]", 0); err == nil {
+		t.Fatal("Run: expected an error for pop on an empty stack, got nil")
+	}
+}
+
+func TestParametricGuardSelectsProduction(t *testing.T) {
+	l, err := NewParametric(
+		map[rune][]string{
+			'F': {
+				"F(x) : x>0 -> F(x-1)",
+				"F(x) : x<=0 -> G",
+			},
+		},
+		map[rune]string{
+			'F': "move $0",
+			'G': "move 0",
+		},
+	)
+	if err != nil {
+		t.Fatalf("NewParametric: %v", err)
+	}
+	if err := l.Run("F(2)", 3); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if pr := l.matchingProduction(symbol{sym: 'F', args: []float64{1}}); pr == nil || pr.replacement[0].sym != 'F' {
+		t.Errorf("F(1): want the x>0 production rewriting to F")
+	}
+	if pr := l.matchingProduction(symbol{sym: 'F', args: []float64{0}}); pr == nil || pr.replacement[0].sym != 'G' {
+		t.Errorf("F(0): want the x<=0 production rewriting to G")
+	}
+}
+
+func TestParseParamProductionExpr(t *testing.T) {
+	cases := []struct {
+		name string
+		prod string
+		args []float64
+		want []float64
+	}{
+		{"arithmetic", "F(x) -> F(x*2)", []float64{3}, []float64{6}},
+		{"guard true keeps replacement", "F(x) : x>0 -> G(x)", []float64{1}, []float64{1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sym, pr, err := parseParamProduction(c.prod)
+			if err != nil {
+				t.Fatalf("parseParamProduction(%q): %v", c.prod, err)
+			}
+			_ = sym
+			if !pr.matches(c.args) {
+				t.Fatalf("matches(%v) = false, want true", c.args)
+			}
+			if len(pr.replacement) != 1 {
+				t.Fatalf("got %d replacement symbols, want 1", len(pr.replacement))
+			}
+			got := make([]float64, len(pr.replacement[0].args))
+			for i, a := range pr.replacement[0].args {
+				got[i] = a(c.args)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("got %v args, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("arg %d = %v, want %v", i, got[i], c.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParametricWriteSVGRecordsDraws(t *testing.T) {
+	l, err := NewParametric(
+		map[rune][]string{
+			'F': {"F(x) : x>0 -> F(x-1)"},
+		},
+		map[rune]string{
+			'F': "draw #ff0000ff 1 $0",
+		},
+	)
+	if err != nil {
+		t.Fatalf("NewParametric: %v", err)
+	}
+	if err := l.Run("F(5)", 0); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := l.WriteSVG(&buf); err != nil {
+		t.Fatalf("WriteSVG: %v", err)
+	}
+	if !strings.Contains(buf.String(), "<line") {
+		t.Errorf("WriteSVG output has no <line> element:\n%s", buf.String())
+	}
+}